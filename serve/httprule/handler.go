@@ -2,10 +2,13 @@ package httprule
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"mime"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 
 	"foxygo.at/jig/log"
@@ -14,12 +17,25 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/dynamicpb"
 )
 
+// ContentTypeSSE is the media type used for server-streaming responses
+// requested via an `Accept: text/event-stream` header.
+const ContentTypeSSE = "text/event-stream"
+
+// streamFraming identifies how messages on a server-streaming response are
+// framed on the wire, chosen from the request's Accept header.
+type streamFraming int
+
+const (
+	streamFramingJSON  streamFraming = iota // newline-delimited JSON
+	streamFramingSSE                        // Server-Sent Events
+	streamFramingProto                      // length-prefixed binary proto
+)
+
 type httpMethod struct {
 	desc protoreflect.MethodDescriptor
 	rule *annotations.HttpRule
@@ -27,11 +43,21 @@ type httpMethod struct {
 
 // Handler serves protobuf methods, annotated using httprule options, over HTTP.
 type Handler struct {
-	httpMethods    []*httpMethod
-	grpcHandler    grpc.StreamHandler
-	log            log.Logger
-	ruleTemplates  []*annotations.HttpRule
-	defaultHandler http.Handler
+	httpMethods      []*httpMethod
+	router           *router
+	grpcHandler      grpc.StreamHandler
+	log              log.Logger
+	ruleTemplates    []*annotations.HttpRule
+	defaultHandler   http.Handler
+	marshalers       map[string]Marshaler
+	defaultMarshaler Marshaler
+	errorHandler     ErrorHandler
+
+	incomingHeaderMatcher HeaderMatcher
+	outgoingHeaderMatcher HeaderMatcher
+
+	middleware []func(http.Handler) http.Handler
+	dispatcher http.Handler // h.dispatch wrapped in middleware, built by NewHandler
 }
 
 // NewHandler returns a new [Handler] that implements [http.Handler] that will
@@ -51,7 +77,33 @@ func NewHandler(files *registry.Files, handler grpc.StreamHandler, options ...Op
 	if h.log == nil {
 		h.log = log.NewLogger(os.Stderr, log.LogLevelError)
 	}
+	if h.marshalers == nil {
+		h.marshalers = defaultMarshalers()
+	}
+	if h.defaultMarshaler == nil {
+		h.defaultMarshaler = h.marshalers[ContentTypeJSON]
+	}
+	if h.errorHandler == nil {
+		h.errorHandler = h.defaultErrorHandler
+	}
+	if h.incomingHeaderMatcher == nil {
+		h.incomingHeaderMatcher = defaultIncomingHeaderMatcher
+	}
+	if h.outgoingHeaderMatcher == nil {
+		h.outgoingHeaderMatcher = defaultOutgoingHeaderMatcher
+	}
 	h.httpMethods = loadHTTPRules(h.log, files, h.ruleTemplates)
+	h.router = newRouter()
+	for _, m := range h.httpMethods {
+		if err := h.router.add(m); err != nil {
+			h.log.Warnf("%s", err)
+		}
+	}
+
+	h.dispatcher = http.HandlerFunc(h.dispatch)
+	for i := len(h.middleware) - 1; i >= 0; i-- {
+		h.dispatcher = h.middleware[i](h.dispatcher)
+	}
 
 	return h, nil
 }
@@ -89,6 +141,119 @@ func WithDefaultHandler(next http.Handler) Option {
 	}
 }
 
+// HeaderMatcher decides whether a header crossing the HTTP/gRPC boundary is
+// propagated, and under what name. For [WithIncomingHeaderMatcher] it is
+// given an HTTP request header name and returns the gRPC metadata key to
+// store it under; for [WithOutgoingHeaderMatcher] it is given a gRPC
+// metadata key and returns the HTTP response header name. Returning false
+// drops the header.
+type HeaderMatcher func(string) (string, bool)
+
+// grpcMetadataHeaderPrefix is stripped from (added to) incoming (outgoing)
+// headers that are not otherwise recognized by the default HeaderMatchers.
+const grpcMetadataHeaderPrefix = "Grpc-Metadata-"
+
+// defaultIncomingHeaderMatcher passes Authorization and X-Request-Id through
+// under their own lower-cased names, and anything prefixed Grpc-Metadata-
+// lower-cased with that prefix stripped. Everything else is dropped.
+func defaultIncomingHeaderMatcher(header string) (string, bool) {
+	canonical := http.CanonicalHeaderKey(header)
+	switch canonical {
+	case "Authorization", "X-Request-Id":
+		return strings.ToLower(canonical), true
+	}
+	if strings.HasPrefix(canonical, grpcMetadataHeaderPrefix) {
+		return strings.ToLower(canonical[len(grpcMetadataHeaderPrefix):]), true
+	}
+	return "", false
+}
+
+// defaultOutgoingHeaderMatcher forwards every gRPC metadata key, prefixed
+// with Grpc-Metadata- so it cannot collide with headers set elsewhere in
+// the response.
+func defaultOutgoingHeaderMatcher(key string) (string, bool) {
+	return grpcMetadataHeaderPrefix + key, true
+}
+
+// WithIncomingHeaderMatcher is an [Option] to configure a [Handler] with a
+// [HeaderMatcher] that selects which HTTP request headers are propagated
+// into the gRPC metadata available from a handler's
+// [metadata.FromIncomingContext].
+func WithIncomingHeaderMatcher(m HeaderMatcher) Option {
+	return func(h *Handler) error {
+		h.incomingHeaderMatcher = m
+		return nil
+	}
+}
+
+// WithOutgoingHeaderMatcher is an [Option] to configure a [Handler] with a
+// [HeaderMatcher] that selects which gRPC metadata, set by a handler via
+// SetHeader/SendHeader/SetTrailer, is propagated as HTTP response headers
+// and trailers.
+func WithOutgoingHeaderMatcher(m HeaderMatcher) Option {
+	return func(h *Handler) error {
+		h.outgoingHeaderMatcher = m
+		return nil
+	}
+}
+
+// WithMiddleware is an [Option] to wrap a [Handler]'s [Handler.ServeHTTP]
+// with the given middleware, in registration order: the first middleware
+// given is outermost, running first on a request and last on its response.
+// Each call appends to any middleware already configured.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return func(h *Handler) error {
+		h.middleware = append(h.middleware, mw...)
+		return nil
+	}
+}
+
+// ErrorHandler writes the HTTP response for an error returned by a gRPC
+// handler invoked through a [Handler]. acceptType is the content type
+// negotiated for the request, or "" if it could not be determined.
+type ErrorHandler func(ctx context.Context, w http.ResponseWriter, r *http.Request, acceptType string, err error)
+
+// WithErrorHandler is an [Option] to configure a [Handler] with a custom
+// [ErrorHandler], replacing the default translation of a [status.Status]
+// into an HTTP response. Use it to change the error body shape, add
+// response headers, or observe errors before they are written.
+func WithErrorHandler(eh ErrorHandler) Option {
+	return func(h *Handler) error {
+		h.errorHandler = eh
+		return nil
+	}
+}
+
+// defaultErrorHandler is the [ErrorHandler] a [Handler] uses unless
+// [WithErrorHandler] overrides it: it marshals the error's [status.Status]
+// with the Marshaler registered for acceptType, falling back to JSON.
+func (h *Handler) defaultErrorHandler(_ context.Context, w http.ResponseWriter, _ *http.Request, acceptType string, err error) {
+	// Fallback message if error marshalling fails.
+	const errMarshalFailed = `{"code": 13, "message": "failed to marshal error message"}`
+
+	st := status.Convert(err)
+	marshaler := Marshaler(jsonMarshaler{})
+	if acceptType != "" {
+		if m, ok := h.marshalers[acceptType]; ok {
+			marshaler = m
+		}
+	}
+	w.Header().Set("Content-Type", marshaler.ContentType())
+
+	buf, merr := marshaler.Marshal(st.Proto())
+	if merr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, werr := w.Write([]byte(errMarshalFailed)); werr != nil {
+			h.log.Errorf("failed to write error response: %+v", werr)
+		}
+		return
+	}
+	w.WriteHeader(HTTPStatusFromCode(st.Code()))
+	if _, werr := w.Write(buf); werr != nil {
+		h.log.Errorf("failed to write error response: %+v", werr)
+	}
+}
+
 // Server is a [Handler], and exists for backwards compatibility.
 //
 // Deprecated: Use [Handler] instead.
@@ -103,25 +268,41 @@ func NewServer(files *registry.Files, handler grpc.StreamHandler, l log.Logger,
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for _, method := range h.httpMethods {
-		if vars := MatchRequest(method.rule, r); vars != nil {
-			h.serveHTTPMethod(method, vars, w, r)
-			return
-		}
+	h.dispatcher.ServeHTTP(w, r)
+}
+
+// dispatch matches r against the compiled path templates and serves it,
+// falling back to defaultHandler if none match. It is wrapped in any
+// configured middleware to form dispatcher.
+func (h *Handler) dispatch(w http.ResponseWriter, r *http.Request) {
+	if m, vars := h.router.match(r); m != nil {
+		h.serveHTTPMethod(m, vars, w, r)
+		return
 	}
 	h.defaultHandler.ServeHTTP(w, r)
 }
 
 // Serve a google.api.http annotated method as HTTP
 func (h *Handler) serveHTTPMethod(m *httpMethod, vars map[string]string, w http.ResponseWriter, r *http.Request) {
-	// TODO: Handle streaming calls.
+	if m.desc.IsStreamingClient() {
+		// Client and bidirectional streaming have no natural mapping onto a
+		// single HTTP request/response pair, so they are left unsupported.
+		http.Error(w, "client-streaming gRPC methods are not supported over HTTP", http.StatusNotImplemented)
+		return
+	}
 	ss := &serverStream{
-		req:        r,
-		respWriter: w,
-		rule:       m.rule,
-		vars:       vars,
-		log:        h.log,
+		req:                   r,
+		respWriter:            w,
+		rule:                  m.rule,
+		vars:                  vars,
+		log:                   h.log,
+		streaming:             m.desc.IsStreamingServer(),
+		marshalers:            h.marshalers,
+		defaultMarshaler:      h.defaultMarshaler,
+		errorHandler:          h.errorHandler,
+		outgoingHeaderMatcher: h.outgoingHeaderMatcher,
 	}
+	ss.ctx = incomingContext(r, h.incomingHeaderMatcher)
 	if err := h.grpcHandler(m.desc.FullName(), ss); err != nil {
 		ss.writeError(err)
 		return
@@ -129,6 +310,21 @@ func (h *Handler) serveHTTPMethod(m *httpMethod, vars map[string]string, w http.
 	ss.writeResp()
 }
 
+// incomingContext attaches the gRPC metadata selected by matcher from r's
+// headers to r.Context(), which already carries r's deadline and
+// cancellation.
+func incomingContext(r *http.Request, matcher HeaderMatcher) context.Context {
+	md := metadata.MD{}
+	for header, values := range r.Header {
+		key, ok := matcher(header)
+		if !ok {
+			continue
+		}
+		md.Append(key, values...)
+	}
+	return metadata.NewIncomingContext(r.Context(), md)
+}
+
 func loadHTTPRules(l log.Logger, files *registry.Files, httpRuleTemplates []*annotations.HttpRule) []*httpMethod {
 	var httpMethods []*httpMethod
 	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
@@ -187,12 +383,32 @@ type serverStream struct {
 	header     metadata.MD
 	trailer    metadata.MD
 	req        *http.Request
+	ctx        context.Context
 	respWriter http.ResponseWriter
 	rule       *annotations.HttpRule
 	vars       map[string]string
 	acceptType string
 	resp       proto.Message
 	log        log.Logger
+
+	// marshalers and defaultMarshaler are the Handler's registered
+	// Marshalers; marshaler is the one negotiated from the request's Accept
+	// header by RecvMsg.
+	marshalers       map[string]Marshaler
+	defaultMarshaler Marshaler
+	marshaler        Marshaler
+	errorHandler     ErrorHandler
+
+	// outgoingHeaderMatcher selects which header/trailer metadata set via
+	// SetHeader/SendHeader/SetTrailer is propagated to the HTTP response.
+	outgoingHeaderMatcher HeaderMatcher
+
+	// streaming is true for server-streaming gRPC methods, which switch
+	// SendMsg into writing and flushing each message as it arrives instead
+	// of buffering a single response for writeResp.
+	streaming     bool
+	streamFraming streamFraming
+	headerWritten bool
 }
 
 var _ grpc.ServerStream = &serverStream{}
@@ -219,22 +435,129 @@ func (s *serverStream) SetTrailer(md metadata.MD) {
 }
 
 func (s *serverStream) Context() context.Context {
-	// TODO: Propagate metadata to headers.
-	return s.req.Context()
+	return s.ctx
 }
 
 func (s *serverStream) SendMsg(m interface{}) error {
-	// Message is buffered until the RPC returns since we don't support client streaming... yet.
-	if s.resp != nil {
-		panic("only one response expected!")
+	msg := m.(proto.Message)
+	if !s.streaming {
+		// Message is buffered until the RPC returns since unary methods
+		// only ever send one response.
+		if s.resp != nil {
+			panic("only one response expected!")
+		}
+		s.resp = msg
+		return nil
+	}
+	return s.sendStreamMsg(msg)
+}
+
+// sendStreamMsg writes and flushes a single message of a server-streaming
+// response, writing the response header first if this is the first message.
+func (s *serverStream) sendStreamMsg(m proto.Message) error {
+	if !s.headerWritten {
+		s.writeStreamHeader()
+	}
+
+	buf, err := s.marshaler.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	w := s.respWriter
+	switch s.streamFraming {
+	case streamFramingSSE:
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", buf); err != nil {
+			return err
+		}
+	case streamFramingProto:
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(buf)))
+		if _, err := w.Write(size[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	default: // streamFramingJSON
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
 	}
-	s.resp = m.(proto.Message)
 	return nil
 }
 
+// writeStreamHeader picks the wire framing for a server-streaming response
+// from the negotiated Accept type, and writes the response header. Because
+// it runs on the first SendMsg, only trailer metadata set before the first
+// message is declared as an HTTP trailer; SetTrailer calls made while or
+// after streaming responses are sent are not propagated.
+func (s *serverStream) writeStreamHeader() {
+	switch s.acceptType {
+	case ContentTypeSSE:
+		s.streamFraming = streamFramingSSE
+	case ContentTypeBinaryProto:
+		s.streamFraming = streamFramingProto
+	default:
+		s.streamFraming = streamFramingJSON
+	}
+
+	w := s.respWriter
+	s.writeOutgoingHeaders()
+	w.Header().Set("Content-Type", s.acceptType)
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.WriteHeader(http.StatusOK)
+	s.headerWritten = true
+}
+
+// writeOutgoingHeaders copies header metadata set via SetHeader/SendHeader
+// onto the HTTP response, and declares the names of any trailer metadata
+// already set via SetTrailer so net/http treats them as trailers rather
+// than headers. It must be called before the response headers are written.
+func (s *serverStream) writeOutgoingHeaders() {
+	w := s.respWriter
+	for key, values := range s.header {
+		name, ok := s.outgoingHeaderMatcher(key)
+		if !ok {
+			continue
+		}
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	for key := range s.trailer {
+		if name, ok := s.outgoingHeaderMatcher(key); ok {
+			w.Header().Add("Trailer", name)
+		}
+	}
+}
+
+// writeOutgoingTrailers copies trailer metadata set via SetTrailer onto the
+// HTTP response. It must be called after the response body, and only for
+// trailer names already declared by writeOutgoingHeaders.
+func (s *serverStream) writeOutgoingTrailers() {
+	w := s.respWriter
+	for key, values := range s.trailer {
+		name, ok := s.outgoingHeaderMatcher(key)
+		if !ok {
+			continue
+		}
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+}
+
 func (s *serverStream) RecvMsg(m interface{}) error {
 	var err error
-	s.acceptType, err = getAcceptType(s.req)
+	s.acceptType, s.marshaler, err = getAcceptType(s.req, s.marshalers, s.defaultMarshaler, s.streaming)
 	if err != nil {
 		return err
 	}
@@ -244,8 +567,17 @@ func (s *serverStream) RecvMsg(m interface{}) error {
 }
 
 func (s *serverStream) writeResp() {
-	// TODO: forward headers and trailers.
-	msg, err := marshalerForContentType(s.acceptType)(s.resp)
+	if s.streaming {
+		// Messages, and the headers declaring trailer names, were already
+		// written and flushed by sendStreamMsg/writeStreamHeader.
+		if s.headerWritten {
+			s.writeOutgoingTrailers()
+		}
+		return
+	}
+	s.writeOutgoingHeaders()
+	s.respWriter.Header().Set("Content-Type", s.acceptType)
+	msg, err := s.marshaler.Marshal(s.resp)
 	if err != nil {
 		s.writeError(err)
 		return
@@ -254,62 +586,104 @@ func (s *serverStream) writeResp() {
 		s.log.Errorf("failed to write response")
 		return
 	}
+	s.writeOutgoingTrailers()
 }
 
 func (s *serverStream) writeError(err error) {
-	// Fallback message if error marshalling fails.
-	const errMarshalFailed = `{"code": 13, "message": "failed to marshal error message"}`
+	if s.streaming && s.headerWritten {
+		s.writeStreamError(err)
+		return
+	}
+	s.errorHandler(s.req.Context(), s.respWriter, s.req, s.acceptType, err)
+}
 
-	w := s.respWriter
+// writeStreamError terminates an in-progress server-streaming response with
+// a final error frame, since the HTTP status code and headers were already
+// committed by the first call to sendStreamMsg.
+func (s *serverStream) writeStreamError(err error) {
 	st := status.Convert(err)
-	// If we don't understand the "Accept" header, error back in JSON without setting Content-Type.
-	marshaler := protojson.Marshal
-	if s.acceptType != "" {
-		marshaler = marshalerForContentType(s.acceptType)
-		w.Header().Set("Content-Type", s.acceptType)
+	buf, merr := s.marshaler.Marshal(st.Proto())
+	if merr != nil {
+		buf = []byte(`{"code": 13, "message": "failed to marshal error message"}`)
 	}
 
-	buf, err := marshaler(st.Proto())
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		if _, err = w.Write([]byte(errMarshalFailed)); err != nil {
-			s.log.Errorf("failed to write error response: %+v", err)
+	w := s.respWriter
+	switch s.streamFraming {
+	case streamFramingSSE:
+		if _, err := fmt.Fprintf(w, "event: error\ndata: %s\n\n", buf); err != nil {
+			s.log.Errorf("failed to write stream error: %+v", err)
+		}
+	case streamFramingProto:
+		// There is no in-band way to signal an error within a length-prefixed
+		// binary proto stream, so nothing is written and the response ends
+		// the same way as a stream that finished without error.
+	default: // streamFramingJSON
+		if _, err := fmt.Fprintf(w, "%s\n", buf); err != nil {
+			s.log.Errorf("failed to write stream error: %+v", err)
 		}
-		return
 	}
-	s.respWriter.WriteHeader(HTTPStatusFromCode(st.Code()))
-	if _, err = s.respWriter.Write(buf); err != nil {
-		s.log.Errorf("failed to write error response: %+v", err)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
 	}
 }
 
-func getAcceptType(r *http.Request) (string, error) {
-	var err error
-	mediaType := ContentTypeJSON
-	// TODO: There's a lot more to parsing Accept headers...
+// getAcceptType negotiates the content type of a response from the
+// request's Accept header (falling back to Content-Type, then def),
+// returning the chosen content type and its Marshaler. Media types are
+// tried in order of quality value, highest first; the first one registered
+// in marshalers wins. "text/event-stream" is only accepted when streaming
+// is true, since unary responses have no framing that matches it; def is
+// used to marshal individual messages.
+func getAcceptType(r *http.Request, marshalers map[string]Marshaler, def Marshaler, streaming bool) (string, Marshaler, error) {
 	accept := r.Header.Get("Accept")
 	if accept == "" {
 		accept = r.Header.Get("Content-Type")
 	}
-	if accept != "" && accept != "*/*" {
-		mediaType, _, err = mime.ParseMediaType(accept)
-		if err != nil {
-			return "", err
-		}
+	if accept == "" || accept == "*/*" {
+		return def.ContentType(), def, nil
 	}
-	if mediaType != ContentTypeBinaryProto && mediaType != ContentTypeJSON {
-		return "", fmt.Errorf("invalid Accept content type %s", accept)
+
+	for _, mediaType := range parseAcceptHeader(accept) {
+		if mediaType == ContentTypeSSE {
+			if streaming {
+				return ContentTypeSSE, def, nil
+			}
+			continue
+		}
+		if m, ok := marshalers[mediaType]; ok {
+			return mediaType, m, nil
+		}
 	}
-	return mediaType, nil
+	return "", nil, fmt.Errorf("invalid Accept content type %s", accept)
 }
 
-func marshalerForContentType(mediaType string) func(m proto.Message) ([]byte, error) {
-	switch mediaType {
-	case ContentTypeBinaryProto:
-		return proto.Marshal
-	case ContentTypeJSON:
-		return protojson.Marshal
-	default:
-		panic("invalid content type")
+// parseAcceptHeader parses an Accept header's comma-separated media ranges,
+// returning their media types ordered by "q" parameter (RFC 7231 §5.3.2)
+// from highest quality to lowest. Entries that fail to parse are skipped.
+func parseAcceptHeader(accept string) []string {
+	type entry struct {
+		mediaType string
+		quality   float64
+	}
+	var entries []entry
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+		entries = append(entries, entry{mediaType, quality})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].quality > entries[j].quality })
+
+	mediaTypes := make([]string, len(entries))
+	for i, e := range entries {
+		mediaTypes[i] = e.mediaType
 	}
+	return mediaTypes
 }
@@ -0,0 +1,114 @@
+package httprule
+
+import (
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"sigs.k8s.io/yaml"
+)
+
+// Content types served by the built-in Marshalers.
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeBinaryProto = "application/x-protobuf"
+	ContentTypeYAML        = "application/yaml"
+
+	// prettyContentTypeSuffix selects the indented variant of a JSON-like
+	// Marshaler, e.g. registered as "application/json+pretty".
+	prettyContentTypeSuffix = "+pretty"
+)
+
+// Marshaler converts a protobuf message to the wire format of a single
+// content type for a response body. Register one with [WithMarshaler] to
+// support a response wire format beyond the built-ins (JSON, pretty JSON,
+// YAML and binary proto). Marshalers only affect responses: request bodies
+// are always decoded by DecodeRequest, regardless of the request's
+// Content-Type.
+type Marshaler interface {
+	// ContentType is the media type of this Marshaler's output. It is set
+	// as the response Content-Type when this Marshaler is a [Handler]'s
+	// default or renders an error. A request's Accept or Content-Type
+	// header is matched against the content type given to [WithMarshaler],
+	// not against this value.
+	ContentType() string
+	Marshal(m proto.Message) ([]byte, error)
+}
+
+type jsonMarshaler struct {
+	opts protojson.MarshalOptions
+}
+
+func (j jsonMarshaler) ContentType() string { return ContentTypeJSON }
+
+func (j jsonMarshaler) Marshal(m proto.Message) ([]byte, error) {
+	return j.opts.Marshal(m)
+}
+
+// prettyJSONMarshaler is jsonMarshaler with indentation enabled, registered
+// under the "+pretty" content type suffix.
+type prettyJSONMarshaler struct {
+	jsonMarshaler
+}
+
+func (prettyJSONMarshaler) ContentType() string {
+	return ContentTypeJSON + prettyContentTypeSuffix
+}
+
+type protoMarshaler struct{}
+
+func (protoMarshaler) ContentType() string { return ContentTypeBinaryProto }
+
+func (protoMarshaler) Marshal(m proto.Message) ([]byte, error) { return proto.Marshal(m) }
+
+// yamlMarshaler round-trips through protojson's JSON representation, since
+// proto messages have no native YAML mapping.
+type yamlMarshaler struct{}
+
+func (yamlMarshaler) ContentType() string { return ContentTypeYAML }
+
+func (yamlMarshaler) Marshal(m proto.Message) ([]byte, error) {
+	buf, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(buf)
+}
+
+// defaultMarshalers returns the built-in Marshalers a [Handler] registers
+// unless overridden with [WithMarshaler].
+func defaultMarshalers() map[string]Marshaler {
+	pretty := prettyJSONMarshaler{jsonMarshaler{opts: protojson.MarshalOptions{Multiline: true, Indent: "  "}}}
+	return map[string]Marshaler{
+		ContentTypeJSON:        jsonMarshaler{},
+		pretty.ContentType():   pretty,
+		ContentTypeBinaryProto: protoMarshaler{},
+		ContentTypeYAML:        yamlMarshaler{},
+	}
+}
+
+// WithMarshaler is an [Option] to register a [Marshaler] on a [Handler]
+// under contentType, replacing any existing Marshaler registered for that
+// content type. It lets callers support response wire
+// formats beyond the built-in JSON, pretty JSON, YAML and binary proto
+// encodings; request bodies are unaffected, see [Marshaler].
+func WithMarshaler(contentType string, m Marshaler) Option {
+	return func(h *Handler) error {
+		if h.marshalers == nil {
+			h.marshalers = defaultMarshalers()
+		}
+		h.marshalers[contentType] = m
+		return nil
+	}
+}
+
+// WithDefaultMarshaler is an [Option] to set the [Marshaler] a [Handler]
+// falls back to when a request has neither an Accept nor a Content-Type
+// header, or its Accept header is exactly "*/*". An Accept header that
+// names no registered content type is rejected with an error rather than
+// served with this Marshaler. The default is JSON. It only affects
+// responses; see [Marshaler].
+func WithDefaultMarshaler(m Marshaler) Option {
+	return func(h *Handler) error {
+		h.defaultMarshaler = m
+		return nil
+	}
+}
@@ -0,0 +1,46 @@
+// Package middleware provides a small set of net/http middleware usable
+// with [foxygo.at/jig/serve/httprule.WithMiddleware] and
+// [foxygo.at/jig/serve.WithMiddleware].
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORS returns a middleware that adds Cross-Origin Resource Sharing
+// response headers for the given allowed origins, methods and headers. An
+// allowedOrigins entry of "*" allows every origin. Preflight OPTIONS
+// requests are answered directly and not passed to next.
+func CORS(allowedOrigins, allowedMethods, allowedHeaders []string) func(http.Handler) http.Handler {
+	origins := make(map[string]bool, len(allowedOrigins))
+	allowAllOrigins := false
+	for _, o := range allowedOrigins {
+		if o == "*" {
+			allowAllOrigins = true
+		}
+		origins[o] = true
+	}
+	methods := strings.Join(allowedMethods, ", ")
+	headers := strings.Join(allowedHeaders, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if origin := r.Header.Get("Origin"); origin != "" && (allowAllOrigins || origins[origin]) {
+				if allowAllOrigins {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+				} else {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Add("Vary", "Origin")
+				}
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+
+	"foxygo.at/jig/serve/httprule"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Recovery returns a middleware that recovers a panic in next, converting
+// it into a codes.Internal error written through eh rather than letting it
+// crash the server or fall through to net/http's default panic handling.
+// Pass the same [httprule.ErrorHandler] configured on the [httprule.Handler]
+// via [httprule.WithErrorHandler] so recovered panics are rendered the same
+// way as other errors.
+func Recovery(eh httprule.ErrorHandler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if rec := recover(); rec != nil {
+					eh(r.Context(), w, r, "", status.Errorf(codes.Internal, "panic: %v", rec))
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
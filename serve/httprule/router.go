@@ -0,0 +1,350 @@
+package httprule
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+// router dispatches an *http.Request to the httpMethod whose HttpRule path
+// template matches it, in O(path length) rather than O(number of rules): each
+// registered template is compiled once into a sequence of segments and
+// inserted into a trie keyed by HTTP method, so matching walks the trie
+// instead of re-parsing every template per request.
+type router struct {
+	methods map[string]*routeTrie // HTTP method (GET, POST, a custom verb, ...) -> trie root
+}
+
+func newRouter() *router {
+	return &router{methods: map[string]*routeTrie{}}
+}
+
+// add compiles m's HttpRule path template and inserts it into the trie for
+// its HTTP method.
+func (rt *router) add(m *httpMethod) error {
+	verb, template := httpRuleMethodAndTemplate(m.rule)
+	if template == "" {
+		return fmt.Errorf("httprule: %s: HttpRule has no path template", m.desc.FullName())
+	}
+	ct, err := compileTemplate(template)
+	if err != nil {
+		return fmt.Errorf("httprule: %s: %w", m.desc.FullName(), err)
+	}
+	root, ok := rt.methods[verb]
+	if !ok {
+		root = &routeTrie{}
+		rt.methods[verb] = root
+	}
+	root.insert(ct.segments, 0, &routeEntry{method: m, variables: ct.variables})
+	return nil
+}
+
+// match finds the httpMethod registered for r, returning the variable
+// bindings from its path template, or (nil, nil) if none matches.
+func (rt *router) match(r *http.Request) (*httpMethod, map[string]string) {
+	root, ok := rt.methods[r.Method]
+	if !ok {
+		return nil, nil
+	}
+	entry, vars, ok := matchTrie(root, r)
+	if !ok {
+		return nil, nil
+	}
+	return entry.method, vars
+}
+
+// matchTrie walks r's path segments against root, returning the matched
+// routeEntry and its bound variables, or (nil, nil, false) if none matches.
+func matchTrie(root *routeTrie, r *http.Request) (*routeEntry, map[string]string, bool) {
+	entry, values, ok := root.match(splitPathSegments(r), 0, nil)
+	if !ok {
+		return nil, nil, false
+	}
+	vars := make(map[string]string, len(entry.variables))
+	for _, v := range entry.variables {
+		vars[v.name] = strings.Join(values[v.start:v.end], "/")
+	}
+	return entry, vars, true
+}
+
+// MatchRequest reports whether r matches rule's HttpRule path template and
+// method, returning the bound path variables, or nil if it does not match.
+// It is a thin adapter over the same compiled-trie matcher [router] uses for
+// per-method dispatch, for callers that only have a single ad-hoc HttpRule
+// to test rather than a registered set of them.
+func MatchRequest(rule *annotations.HttpRule, r *http.Request) map[string]string {
+	verb, template := httpRuleMethodAndTemplate(rule)
+	if template == "" || (verb != "" && r.Method != verb) {
+		return nil
+	}
+	ct, err := compileTemplate(template)
+	if err != nil {
+		return nil
+	}
+	root := &routeTrie{}
+	root.insert(ct.segments, 0, &routeEntry{variables: ct.variables})
+	_, vars, ok := matchTrie(root, r)
+	if !ok {
+		return nil
+	}
+	return vars
+}
+
+// httpRuleMethodAndTemplate extracts the HTTP method and path template from
+// an HttpRule's oneof pattern.
+func httpRuleMethodAndTemplate(rule *annotations.HttpRule) (method, template string) {
+	switch p := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		return http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		return http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		return http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		return http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		return http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		return p.Custom.Kind, p.Custom.Path
+	default:
+		return "", ""
+	}
+}
+
+// splitPathSegments splits r's raw (still percent-encoded) path on "/" and
+// percent-decodes each segment individually rather than the path as a
+// whole, since a "%2F" within a single segment must stay one segment
+// rather than be decoded into a literal "/" and split in two.
+// r.URL.Path has already been whole-path-decoded by net/http, so the split
+// is done on r.URL.EscapedPath() instead.
+func splitPathSegments(r *http.Request) []string {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/")
+	if path == "" {
+		return nil
+	}
+	raw := strings.Split(path, "/")
+	segs := make([]string, len(raw))
+	for i, s := range raw {
+		if decoded, err := url.PathUnescape(s); err == nil {
+			s = decoded
+		}
+		segs[i] = s
+	}
+	return segs
+}
+
+// segmentKind is the kind of a single "/"-delimited token in a compiled
+// path template.
+type segmentKind int
+
+const (
+	segLiteral        segmentKind = iota // a fixed path segment
+	segSingleWildcard                    // "*", matches exactly one segment
+	segMultiWildcard                     // "**", matches one or more segments
+)
+
+type segment struct {
+	kind    segmentKind
+	literal string // set when kind == segLiteral
+}
+
+// variableSpan records that segments [start, end) of a compiledTemplate
+// were written inside a "{name=...}" binding in the source template, and so
+// should be joined back together and bound to name once a path matches.
+type variableSpan struct {
+	name  string
+	start int
+	end   int
+}
+
+// compiledTemplate is a google.api.http path template, such as
+// "/v1/{name=shelves/*}/books/{book_id}", broken into its "/"-delimited
+// segments plus the variable bindings that cover ranges of them.
+type compiledTemplate struct {
+	segments  []segment
+	variables []variableSpan
+}
+
+// compileTemplate parses a google.api.http path template into its segments
+// and variable bindings. The grammar supported is:
+//
+//	Template  = "/" Segments ;
+//	Segments  = Segment { "/" Segment } ;
+//	Segment   = "*" | "**" | LITERAL | Variable ;
+//	Variable  = "{" FieldPath [ "=" Segments ] "}" ;
+//	FieldPath = IDENT { "." IDENT } ;
+//
+// A Variable without an "=" subpattern defaults to "*". "**" may only
+// appear as the last segment of a Variable's subpattern, and of the
+// template as a whole.
+func compileTemplate(template string) (*compiledTemplate, error) {
+	template = strings.TrimPrefix(template, "/")
+	if idx := strings.IndexByte(template, ':'); idx >= 0 {
+		// A trailing ":verb" selects a custom method rather than being part
+		// of the path; dispatch does not distinguish it.
+		template = template[:idx]
+	}
+
+	ct := &compiledTemplate{}
+	for _, raw := range splitRespectingBraces(template) {
+		if !strings.HasPrefix(raw, "{") {
+			seg, err := parseSegment(raw)
+			if err != nil {
+				return nil, err
+			}
+			ct.segments = append(ct.segments, seg)
+			continue
+		}
+		if !strings.HasSuffix(raw, "}") {
+			return nil, fmt.Errorf("unterminated variable %q in template %q", raw, template)
+		}
+		inner := raw[1 : len(raw)-1]
+		name, subpattern := inner, "*"
+		if idx := strings.IndexByte(inner, '='); idx >= 0 {
+			name, subpattern = inner[:idx], inner[idx+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty variable name in template %q", template)
+		}
+
+		start := len(ct.segments)
+		for _, sub := range strings.Split(subpattern, "/") {
+			seg, err := parseSegment(sub)
+			if err != nil {
+				return nil, err
+			}
+			ct.segments = append(ct.segments, seg)
+		}
+		ct.variables = append(ct.variables, variableSpan{name: name, start: start, end: len(ct.segments)})
+	}
+
+	for i, seg := range ct.segments {
+		if seg.kind == segMultiWildcard && i != len(ct.segments)-1 {
+			return nil, fmt.Errorf("%q (\"**\") must be the last segment in template %q", "**", template)
+		}
+	}
+	return ct, nil
+}
+
+func parseSegment(s string) (segment, error) {
+	switch s {
+	case "":
+		return segment{}, fmt.Errorf("empty path segment")
+	case "*":
+		return segment{kind: segSingleWildcard}, nil
+	case "**":
+		return segment{kind: segMultiWildcard}, nil
+	default:
+		return segment{kind: segLiteral, literal: s}, nil
+	}
+}
+
+// splitRespectingBraces splits path on "/", except for "/" characters
+// nested inside a "{...}" variable, since a variable's "=" subpattern may
+// itself contain "/".
+func splitRespectingBraces(path string) []string {
+	var segs []string
+	depth := 0
+	start := 0
+	for i, c := range path {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '/':
+			if depth == 0 {
+				segs = append(segs, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(segs, path[start:])
+}
+
+// routeTrie is one node of a per-HTTP-method trie of compiled path
+// templates. Matching at each node tries, in order: the literal child for
+// the current path segment, the single-segment wildcard child, and finally
+// a "**" entry that consumes every remaining segment.
+type routeTrie struct {
+	children map[string]*routeTrie
+	wildcard *routeTrie
+	multi    *routeEntry
+	entry    *routeEntry // set when a template ends exactly at this node
+}
+
+// routeEntry is the httpMethod registered for one compiled path template,
+// along with where its "{name=...}" variables fall among the matched
+// segments.
+type routeEntry struct {
+	method    *httpMethod
+	variables []variableSpan
+}
+
+func (t *routeTrie) insert(segs []segment, idx int, entry *routeEntry) {
+	if idx == len(segs) {
+		t.entry = entry
+		return
+	}
+	switch seg := segs[idx]; seg.kind {
+	case segLiteral:
+		if t.children == nil {
+			t.children = map[string]*routeTrie{}
+		}
+		child, ok := t.children[seg.literal]
+		if !ok {
+			child = &routeTrie{}
+			t.children[seg.literal] = child
+		}
+		child.insert(segs, idx+1, entry)
+	case segSingleWildcard:
+		if t.wildcard == nil {
+			t.wildcard = &routeTrie{}
+		}
+		t.wildcard.insert(segs, idx+1, entry)
+	case segMultiWildcard:
+		t.multi = entry
+	}
+}
+
+// match walks pathSegs against the trie from idx, accumulating one entry in
+// values per compiled segment consumed so far: the matched segment
+// verbatim for a literal or "*", or every remaining path segment joined
+// with "/" for a "**". values, once returned, can be sliced by a
+// routeEntry's variableSpans to bind its variables.
+func (t *routeTrie) match(pathSegs []string, idx int, values []string) (*routeEntry, []string, bool) {
+	if idx == len(pathSegs) {
+		if t.entry != nil {
+			return t.entry, values, true
+		}
+		return nil, nil, false
+	}
+
+	seg := pathSegs[idx]
+	if child, ok := t.children[seg]; ok {
+		if e, vs, ok := child.match(pathSegs, idx+1, appendCopy(values, seg)); ok {
+			return e, vs, true
+		}
+	}
+	if t.wildcard != nil {
+		if e, vs, ok := t.wildcard.match(pathSegs, idx+1, appendCopy(values, seg)); ok {
+			return e, vs, true
+		}
+	}
+	if t.multi != nil {
+		return t.multi, appendCopy(values, strings.Join(pathSegs[idx:], "/")), true
+	}
+	return nil, nil, false
+}
+
+// appendCopy appends v to a copy of values, so that trying one trie branch
+// (e.g. a literal child) can never affect the slice a sibling branch (e.g.
+// the wildcard fallback) appends to.
+func appendCopy(values []string, v string) []string {
+	next := make([]string, len(values), len(values)+1)
+	copy(next, values)
+	return append(next, v)
+}
@@ -0,0 +1,133 @@
+package httprule
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+// insertTemplate compiles template and inserts it into root, tagging its
+// routeEntry with the template itself so a test can tell which of several
+// overlapping templates matched.
+func insertTemplate(t *testing.T, root *routeTrie, template string) {
+	t.Helper()
+	ct, err := compileTemplate(template)
+	if err != nil {
+		t.Fatalf("compileTemplate(%q): %v", template, err)
+	}
+	rule := &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/" + template}}
+	root.insert(ct.segments, 0, &routeEntry{
+		method:    &httpMethod{rule: rule},
+		variables: ct.variables,
+	})
+}
+
+func matchPath(t *testing.T, root *routeTrie, path string) (map[string]string, bool) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	entry, vars, ok := matchTrie(root, r)
+	if !ok {
+		return nil, false
+	}
+	_, template := httpRuleMethodAndTemplate(entry.method.rule)
+	return vars, template != ""
+}
+
+func TestRouteTrieWildcardPrecedence(t *testing.T) {
+	root := &routeTrie{}
+	insertTemplate(t, root, "v1/shelves/*")
+	insertTemplate(t, root, "v1/shelves/featured")
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/shelves/featured", nil)
+	entry, _, ok := matchTrie(root, r)
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	_, template := httpRuleMethodAndTemplate(entry.method.rule)
+	if template != "/v1/shelves/featured" {
+		t.Errorf("matched template = %q, want the literal segment to win over the wildcard", template)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/v1/shelves/123", nil)
+	entry, vars, ok := matchTrie(root, r)
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	_, template = httpRuleMethodAndTemplate(entry.method.rule)
+	if template != "/v1/shelves/*" {
+		t.Errorf("matched template = %q, want the wildcard fallback", template)
+	}
+	if len(vars) != 0 {
+		t.Errorf("vars = %v, want none (unnamed wildcard)", vars)
+	}
+}
+
+func TestRouteTrieVariableBinding(t *testing.T) {
+	root := &routeTrie{}
+	insertTemplate(t, root, "v1/{name=shelves/*}/books/{book_id}")
+
+	vars, ok := matchPath(t, root, "/v1/shelves/5/books/42")
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	want := map[string]string{"name": "shelves/5", "book_id": "42"}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("vars = %v, want %v", vars, want)
+	}
+}
+
+func TestRouteTrieMultiWildcardTail(t *testing.T) {
+	root := &routeTrie{}
+	insertTemplate(t, root, "v1/shelves/{shelf_id}/books/**")
+
+	vars, ok := matchPath(t, root, "/v1/shelves/7/books/1/2/3")
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	want := map[string]string{"shelf_id": "7"}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("vars = %v, want %v", vars, want)
+	}
+
+	if _, ok := matchPath(t, root, "/v1/shelves/7/books"); ok {
+		t.Error(`"**" must consume at least one segment, so the bare prefix should not match`)
+	}
+}
+
+func TestRouteTriePercentDecodesPerSegment(t *testing.T) {
+	root := &routeTrie{}
+	insertTemplate(t, root, "v1/files/{name}")
+
+	// "%2F" within a single segment must decode to a literal "/" and stay
+	// one segment, rather than being decoded by net/http ahead of dispatch
+	// and split into two segments.
+	vars, ok := matchPath(t, root, "/v1/files/a%2Fb")
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	want := map[string]string{"name": "a/b"}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("vars = %v, want %v", vars, want)
+	}
+}
+
+func TestMatchRequestUsesCompiledTrie(t *testing.T) {
+	rule := &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/shelves/{shelf_id}"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/shelves/42", nil)
+	vars := MatchRequest(rule, r)
+	if want := map[string]string{"shelf_id": "42"}; !reflect.DeepEqual(vars, want) {
+		t.Errorf("vars = %v, want %v", vars, want)
+	}
+
+	if vars := MatchRequest(rule, httptest.NewRequest(http.MethodPost, "/v1/shelves/42", nil)); vars != nil {
+		t.Errorf("vars = %v, want nil for a method that does not match the HttpRule", vars)
+	}
+
+	if vars := MatchRequest(rule, httptest.NewRequest(http.MethodGet, "/v1/shelves/42/books", nil)); vars != nil {
+		t.Errorf("vars = %v, want nil for a path that does not match the template", vars)
+	}
+}
@@ -0,0 +1,105 @@
+package httprule
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestSendStreamMsgFraming(t *testing.T) {
+	cases := []struct {
+		name    string
+		framing streamFraming
+		want    string
+	}{
+		{"json", streamFramingJSON, "{}\n"},
+		{"sse", streamFramingSSE, "data: {}\n\n"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s := &serverStream{respWriter: rec, marshaler: jsonMarshaler{}, streamFraming: tc.framing, headerWritten: true}
+			if err := s.sendStreamMsg(&emptypb.Empty{}); err != nil {
+				t.Fatalf("sendStreamMsg: %v", err)
+			}
+			if got := rec.Body.String(); got != tc.want {
+				t.Errorf("body = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSendStreamMsgProtoFraming(t *testing.T) {
+	rec := httptest.NewRecorder()
+	s := &serverStream{respWriter: rec, marshaler: protoMarshaler{}, streamFraming: streamFramingProto, headerWritten: true}
+	if err := s.sendStreamMsg(&emptypb.Empty{}); err != nil {
+		t.Fatalf("sendStreamMsg: %v", err)
+	}
+
+	body := rec.Body.Bytes()
+	if len(body) < 4 {
+		t.Fatalf("body = %d bytes, want at least a 4-byte length prefix", len(body))
+	}
+	size := binary.BigEndian.Uint32(body[:4])
+	if int(size) != len(body)-4 {
+		t.Errorf("length prefix = %d, want %d (remaining body length)", size, len(body)-4)
+	}
+}
+
+func TestWriteStreamError(t *testing.T) {
+	cases := []struct {
+		name         string
+		framing      streamFraming
+		wantContains string
+	}{
+		{"json", streamFramingJSON, `"code":13`},
+		{"sse", streamFramingSSE, "event: error\ndata: "},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s := &serverStream{respWriter: rec, marshaler: jsonMarshaler{}, streamFraming: tc.framing}
+			s.writeStreamError(status.Error(codes.Internal, "boom"))
+			if got := rec.Body.String(); !strings.Contains(got, tc.wantContains) {
+				t.Errorf("body = %q, want substring %q", got, tc.wantContains)
+			}
+		})
+	}
+}
+
+func TestGetAcceptTypeSSEOnlyForStreaming(t *testing.T) {
+	marshalers := defaultMarshalers()
+	def := marshalers[ContentTypeJSON]
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", ContentTypeSSE)
+
+	acceptType, marshaler, err := getAcceptType(r, marshalers, def, true)
+	if err != nil {
+		t.Fatalf("getAcceptType(streaming=true): %v", err)
+	}
+	if acceptType != ContentTypeSSE || marshaler != def {
+		t.Errorf("got (%q, %v), want (%q, %v) for a streaming method", acceptType, marshaler, ContentTypeSSE, def)
+	}
+
+	if _, _, err := getAcceptType(r, marshalers, def, false); err == nil {
+		t.Error("getAcceptType(streaming=false): want an error, since a unary response has no framing for SSE")
+	}
+}
+
+func TestWriteStreamErrorProtoFramingWritesNothing(t *testing.T) {
+	// A length-prefixed binary proto stream has no in-band way to signal an
+	// error, so writeStreamError must write nothing rather than a frame the
+	// client can't distinguish from data.
+	rec := httptest.NewRecorder()
+	s := &serverStream{respWriter: rec, marshaler: protoMarshaler{}, streamFraming: streamFramingProto}
+	s.writeStreamError(status.Error(codes.Internal, "boom"))
+	if rec.Body.Len() != 0 {
+		t.Errorf("body = %q, want no bytes written for proto framing", rec.Body.String())
+	}
+}
@@ -42,14 +42,37 @@ func WithLogger(logger log.Logger) Option {
 	}
 }
 
+// WithErrorHandler is an Option to configure a Server with a custom
+// httprule.ErrorHandler for translating errors from gRPC handlers into HTTP
+// responses, in place of the default, which marshals the error's status
+// with the Marshaler for the negotiated content type (JSON if none).
+func WithErrorHandler(eh httprule.ErrorHandler) Option {
+	return func(s *Server) error {
+		s.errorHandler = eh
+		return nil
+	}
+}
+
+// WithMiddleware is an Option to wrap a Server's HTTP dispatch path with the
+// given middleware, in registration order: the first middleware given is
+// outermost. It does not affect the native gRPC path in Server.ServeHTTP.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return func(s *Server) error {
+		s.middleware = append(s.middleware, mw...)
+		return nil
+	}
+}
+
 type Server struct {
-	log       log.Logger
-	gs        *grpc.Server
-	http      *httprule.Server
-	files     *registry.Files
-	fs        fs.FS
-	protosets []string
-	eval      Evaluator
+	log          log.Logger
+	gs           *grpc.Server
+	http         *httprule.Handler
+	files        *registry.Files
+	fs           fs.FS
+	protosets    []string
+	eval         Evaluator
+	errorHandler httprule.ErrorHandler
+	middleware   []func(http.Handler) http.Handler
 }
 
 // NewServer creates a new Server for given evaluator, e.g. Jsonnet and
@@ -69,7 +92,18 @@ func NewServer(eval Evaluator, vfs fs.FS, options ...Option) (*Server, error) {
 	if err := s.loadProtosets(); err != nil {
 		return nil, err
 	}
-	s.http = httprule.NewServer(s.files, s.callMethod)
+	httpOpts := []httprule.Option{httprule.WithLogger(s.log)}
+	if s.errorHandler != nil {
+		httpOpts = append(httpOpts, httprule.WithErrorHandler(s.errorHandler))
+	}
+	if len(s.middleware) > 0 {
+		httpOpts = append(httpOpts, httprule.WithMiddleware(s.middleware...))
+	}
+	h, err := httprule.NewHandler(s.files, s.callMethod, httpOpts...)
+	if err != nil {
+		return nil, err
+	}
+	s.http = h
 	return s, nil
 }
 